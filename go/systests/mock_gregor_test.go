@@ -0,0 +1,239 @@
+package systests
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/client"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/go-framed-msgpack-rpc/rpc"
+)
+
+type gregorEventKind int
+
+const (
+	gregorEventTeamChangedByID gregorEventKind = iota
+	gregorEventTeamChangedByName
+	gregorEventTeamDeleted
+	gregorEventTeamExit
+)
+
+// gregorEvent is one entry in a MockGregorBackend's ordered log.
+type gregorEvent struct {
+	kind gregorEventKind
+	at   time.Time
+
+	teamID   keybase1.TeamID
+	teamName keybase1.TeamName
+	byID     keybase1.TeamChangedByIDArg
+	byName   keybase1.TeamChangedByNameArg
+}
+
+// MockGregorBackend stands in for the live gregor notification pipeline in
+// a systest. It satisfies the same method set as teamNotifyHandler, so it
+// can be registered with keybase1.NotifyTeamProtocol alongside a
+// userPlusDevice's real one, but it also lets a test Inject synthetic
+// notifications directly and assert on them with the Expect DSL, without
+// needing the real server to produce them.
+type MockGregorBackend struct {
+	g *libkb.GlobalContext
+
+	mu  sync.Mutex
+	log []gregorEvent
+}
+
+func newMockGregorBackend(g *libkb.GlobalContext) *MockGregorBackend {
+	return &MockGregorBackend{g: g}
+}
+
+func (m *MockGregorBackend) record(ev gregorEvent) {
+	ev.at = time.Now()
+	m.mu.Lock()
+	m.log = append(m.log, ev)
+	m.mu.Unlock()
+}
+
+func (m *MockGregorBackend) snapshot() []gregorEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]gregorEvent, len(m.log))
+	copy(out, m.log)
+	return out
+}
+
+func (m *MockGregorBackend) TeamChangedByID(ctx context.Context, arg keybase1.TeamChangedByIDArg) error {
+	m.record(gregorEvent{kind: gregorEventTeamChangedByID, teamID: arg.TeamID, byID: arg})
+	return nil
+}
+
+func (m *MockGregorBackend) TeamChangedByName(ctx context.Context, arg keybase1.TeamChangedByNameArg) error {
+	m.record(gregorEvent{kind: gregorEventTeamChangedByName, teamName: arg.TeamName, byName: arg})
+	return nil
+}
+
+func (m *MockGregorBackend) TeamDeleted(ctx context.Context, teamID keybase1.TeamID) error {
+	m.record(gregorEvent{kind: gregorEventTeamDeleted, teamID: teamID})
+	return nil
+}
+
+func (m *MockGregorBackend) TeamExit(ctx context.Context, teamID keybase1.TeamID) error {
+	m.record(gregorEvent{kind: gregorEventTeamExit, teamID: teamID})
+	return nil
+}
+
+// TeamRoleMapChanged is accepted but not recorded in the log.
+func (m *MockGregorBackend) TeamRoleMapChanged(ctx context.Context, teamID keybase1.TeamID) error {
+	return nil
+}
+
+// Inject synthesizes a TeamChangedByID notification exactly as if it had
+// come from the real gregor pipeline, so a test can exercise out-of-order
+// seqnos, duplicate rotations, or spurious renames on demand.
+func (m *MockGregorBackend) Inject(arg keybase1.TeamChangedByIDArg) error {
+	return m.TeamChangedByID(context.Background(), arg)
+}
+
+// Expect returns a builder for assertions against this backend's event
+// log, e.g. mock.Expect().TeamRotated(teamID, 3).Within(5 * time.Second).
+func (m *MockGregorBackend) Expect() *gregorExpectations {
+	return &gregorExpectations{m: m}
+}
+
+type gregorExpectations struct {
+	m *MockGregorBackend
+}
+
+// gregorExpectation is a single predicate over the event log, produced by
+// one of the gregorExpectations builder methods.
+type gregorExpectation struct {
+	m     *MockGregorBackend
+	label string
+	pred  func(gregorEvent) bool
+}
+
+// Within polls the log until a matching event has been recorded or the
+// deadline (scaled by libkb.CITimeMultiplier) elapses.
+func (e *gregorExpectation) Within(d time.Duration) error {
+	return PollUntil(context.Background(), e.m.g, e.label,
+		PollOpts{Initial: 50 * time.Millisecond, Max: 250 * time.Millisecond, Multiplier: 1.5, Deadline: d},
+		func() (bool, string, error) {
+			for _, ev := range e.m.snapshot() {
+				if e.pred(ev) {
+					return true, "", nil
+				}
+			}
+			return false, "no matching event observed yet", nil
+		})
+}
+
+func (e *gregorExpectations) TeamRotated(teamID keybase1.TeamID, toSeqno keybase1.Seqno) *gregorExpectation {
+	return &gregorExpectation{
+		m:     e.m,
+		label: fmt.Sprintf("team %s rotated to seqno %d", teamID, toSeqno),
+		pred: func(ev gregorEvent) bool {
+			return ev.kind == gregorEventTeamChangedByID && ev.teamID.Eq(teamID) &&
+				ev.byID.Changes.KeyRotated && ev.byID.LatestSeqno == toSeqno
+		},
+	}
+}
+
+func (e *gregorExpectations) TeamMembershipChanged(teamID keybase1.TeamID, toSeqno keybase1.Seqno) *gregorExpectation {
+	return &gregorExpectation{
+		m:     e.m,
+		label: fmt.Sprintf("team %s membership changed to seqno %d", teamID, toSeqno),
+		pred: func(ev gregorEvent) bool {
+			return ev.kind == gregorEventTeamChangedByID && ev.teamID.Eq(teamID) &&
+				ev.byID.Changes.MembershipChanged && ev.byID.LatestSeqno == toSeqno
+		},
+	}
+}
+
+func (e *gregorExpectations) TeamRenamed(teamID keybase1.TeamID) *gregorExpectation {
+	return &gregorExpectation{
+		m:     e.m,
+		label: fmt.Sprintf("team %s renamed", teamID),
+		pred: func(ev gregorEvent) bool {
+			return ev.kind == gregorEventTeamChangedByID && ev.teamID.Eq(teamID) && ev.byID.Changes.Renamed
+		},
+	}
+}
+
+func (e *gregorExpectations) TeamDeleted(teamID keybase1.TeamID) *gregorExpectation {
+	return &gregorExpectation{
+		m:     e.m,
+		label: fmt.Sprintf("team %s deleted", teamID),
+		pred: func(ev gregorEvent) bool {
+			return ev.kind == gregorEventTeamDeleted && ev.teamID.Eq(teamID)
+		},
+	}
+}
+
+// NoMoreEvents asserts that the log does not grow for the given duration
+// (scaled by libkb.CITimeMultiplier).
+func (e *gregorExpectations) NoMoreEvents(d time.Duration) error {
+	before := len(e.m.snapshot())
+	time.Sleep(d * libkb.CITimeMultiplier(e.m.g))
+	after := len(e.m.snapshot())
+	if after > before {
+		return fmt.Errorf("expected no more events within %s, but observed %d new one(s)", d, after-before)
+	}
+	return nil
+}
+
+// InOrder asserts that each expectation's predicate is satisfied by some
+// log entry, and that those entries appear in the given order.
+func (e *gregorExpectations) InOrder(exps ...*gregorExpectation) error {
+	log := e.m.snapshot()
+	idx := 0
+	for _, exp := range exps {
+		found := false
+		for ; idx < len(log); idx++ {
+			if exp.pred(log[idx]) {
+				found = true
+				idx++
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("expected %s after the previous expectation, but it did not occur in order", exp.label)
+		}
+	}
+	return nil
+}
+
+// addUserWithMockGregor signs up a user the normal way, then opens a
+// second connection to the same service and registers a MockGregorBackend
+// as its NotifyTeamProtocol handler. A go-framed-msgpack-rpc Server keys
+// protocols by name and refuses a second Register call for one already
+// claimed on the same connection, so the mock can't share u.rpcServer
+// with u.notifications -- it needs its own connection, the same way
+// provisionNewDevice opens a fresh one to register UI protocols. The
+// service fans TeamChangedByID/ByName/Deleted/Exit notifications out to
+// every registered connection, so real server traffic lands in both
+// u.notifications and the mock's log; tests can additionally use Inject
+// to synthesize notifications the real server can't be made to produce
+// on demand.
+func (tt *teamTester) addUserWithMockGregor(pre string) (*userPlusDevice, *MockGregorBackend) {
+	u := tt.addUser(pre)
+	m := newMockGregorBackend(u.tc.G)
+
+	cli, xp, err := client.GetRPCClientWithContext(u.tc.G)
+	if err != nil {
+		u.tc.T.Fatal(err)
+	}
+	srv := rpc.NewServer(xp, nil)
+	if err := srv.Register(keybase1.NotifyTeamProtocol(m)); err != nil {
+		u.tc.T.Fatal(err)
+	}
+	ncli := keybase1.NotifyCtlClient{Cli: cli}
+	if err := ncli.SetNotifications(context.Background(), keybase1.NotificationChannels{Team: true}); err != nil {
+		u.tc.T.Fatal(err)
+	}
+
+	u.mockGregor = m
+	return u, m
+}
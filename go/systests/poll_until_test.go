@@ -0,0 +1,67 @@
+package systests
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/libkb"
+)
+
+// PollOpts configures the backoff schedule used by PollUntil.
+type PollOpts struct {
+	// Initial is the delay before the first retry.
+	Initial time.Duration
+	// Max is the ceiling the backoff delay is clamped to.
+	Max time.Duration
+	// Multiplier grows the delay after each failed attempt.
+	Multiplier float64
+	// Deadline is the total time PollUntil will keep retrying before
+	// giving up, before scaling by libkb.CITimeMultiplier.
+	Deadline time.Duration
+}
+
+// PollUntil repeatedly calls pred until it reports done, the deadline in
+// opts elapses, or pred returns a hard error. Delays between attempts grow
+// according to opts and are scaled centrally by libkb.CITimeMultiplier, so
+// call sites no longer need to apply it themselves.
+//
+// pred should be a quick, ideally non-blocking, check. When it is not yet
+// satisfied it returns a human-readable reason, which PollUntil remembers
+// so that a timeout error explains *why* the condition was never met
+// instead of just naming what was being waited for.
+func PollUntil(ctx context.Context, g *libkb.GlobalContext, label string, opts PollOpts, pred func() (done bool, reason string, err error)) error {
+	mult := libkb.CITimeMultiplier(g)
+	interval := opts.Initial * mult
+	max := opts.Max * mult
+	deadline := time.Now().Add(opts.Deadline * mult)
+
+	var lastReason string
+	for {
+		done, reason, err := pred()
+		if err != nil {
+			return fmt.Errorf("error while waiting for %s: %v", label, err)
+		}
+		if done {
+			return nil
+		}
+		if reason != "" {
+			lastReason = reason
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("timed out after %s waiting for %s: %s", opts.Deadline*mult, label, lastReason)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+
+		interval = time.Duration(float64(interval) * opts.Multiplier)
+		if interval > max {
+			interval = max
+		}
+	}
+}
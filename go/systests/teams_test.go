@@ -1,7 +1,9 @@
 package systests
 
 import (
+	"fmt"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -28,6 +30,25 @@ func TestTeamCreate(t *testing.T) {
 	tt.users[0].addTeamMember(team, tt.users[1].username, keybase1.TeamRole_WRITER)
 }
 
+// TestTeamCreateManyUsersAsync exercises AddUserAsync/Start: five users are
+// queued up front and signed up concurrently instead of one at a time.
+func TestTeamCreateManyUsersAsync(t *testing.T) {
+	tt := newTeamTester(t)
+	defer tt.cleanup()
+
+	var handles []*userHandle
+	for i := 0; i < 5; i++ {
+		handles = append(handles, tt.AddUserAsync(fmt.Sprintf("u%d", i)))
+	}
+	require.NoError(t, tt.Start(context.TODO()))
+
+	owner := handles[0].Await()
+	team := owner.createTeam()
+	for _, h := range handles[1:] {
+		owner.addTeamMember(team, h.Await().username, keybase1.TeamRole_WRITER)
+	}
+}
+
 func TestTeamBustCache(t *testing.T) {
 	tt := newTeamTester(t)
 	defer tt.cleanup()
@@ -45,24 +66,24 @@ func TestTeamBustCache(t *testing.T) {
 	tt.users[1].addTeamMember(team, tt.users[2].username, keybase1.TeamRole_WRITER)
 
 	// Poll for an update, we should get it as soon as gregor tells us to bust our cache.
-	backoff := 100 * time.Millisecond
-	found := false
-	for i := 0; i < 10; i++ {
-		after, err := teams.Load(context.TODO(), tt.users[0].tc.G, keybase1.LoadTeamArg{
-			Name:    team,
-			StaleOK: true,
+	var lastSeqno keybase1.Seqno
+	err = PollUntil(context.TODO(), tt.users[0].tc.G, fmt.Sprintf("team %s cache bust past seqno %d", team, beforeSeqno),
+		PollOpts{Initial: 100 * time.Millisecond, Max: 2 * time.Second, Multiplier: 1.5, Deadline: 10 * time.Second},
+		func() (bool, string, error) {
+			after, err := teams.Load(context.TODO(), tt.users[0].tc.G, keybase1.LoadTeamArg{
+				Name:    team,
+				StaleOK: true,
+			})
+			if err != nil {
+				return false, "", err
+			}
+			lastSeqno = after.CurrentSeqno()
+			if lastSeqno > beforeSeqno {
+				return true, "", nil
+			}
+			return false, fmt.Sprintf("still at seqno %d", lastSeqno), nil
 		})
-		require.NoError(t, err)
-		if after.CurrentSeqno() > beforeSeqno {
-			t.Logf("Found new seqno %d at poll loop iter %d", after.CurrentSeqno(), i)
-			found = true
-			break
-		}
-		t.Logf("Still at old generation %d at poll loop iter %d", beforeSeqno, i)
-		time.Sleep(backoff)
-		backoff += backoff / 2
-	}
-	require.True(t, found)
+	require.NoError(t, err)
 }
 
 func TestTeamRotateOnRevoke(t *testing.T) {
@@ -108,28 +129,182 @@ func TestTeamRotateOnRevoke(t *testing.T) {
 	}
 }
 
+// TestTeamRotateHidden exercises a rotation that only touches the hidden
+// sigchain (e.g. a stealth PTK rotation). The visible seqno must not move,
+// while the hidden seqno and the PTK generation implied by the hidden
+// chain both advance.
+func TestTeamRotateHidden(t *testing.T) {
+	tt := newTeamTester(t)
+	defer tt.cleanup()
+
+	tt.addUser("onr")
+	tt.addUser("wtr")
+
+	teamID, teamName := tt.users[0].createTeam2()
+	tt.users[0].addTeamMember(teamName.String(), tt.users[1].username, keybase1.TeamRole_WRITER)
+	tt.users[0].waitForTeamChangedGregor(teamID, keybase1.Seqno(2))
+
+	visibleBefore := tt.users[0].getTeamSeqno(teamID)
+	hiddenBefore := tt.users[0].getHiddenTeamSeqno(teamID)
+	ptkGenBefore := tt.users[0].getHiddenTeamPTKGeneration(teamID)
+
+	err := teams.RotateKeyHidden(context.TODO(), tt.users[0].tc.G, teamID)
+	require.NoError(t, err)
+
+	tt.users[0].waitForHiddenRotate(teamID, hiddenBefore+1)
+
+	visibleAfter := tt.users[0].getTeamSeqno(teamID)
+	hiddenAfter := tt.users[0].getHiddenTeamSeqno(teamID)
+	ptkGenAfter := tt.users[0].getHiddenTeamPTKGeneration(teamID)
+
+	require.Equal(t, visibleBefore, visibleAfter, "visible seqno should not move on a hidden rotation")
+	require.Equal(t, hiddenBefore+1, hiddenAfter, "hidden seqno should advance by one")
+	require.True(t, ptkGenAfter > ptkGenBefore, "PTK generation should advance with the hidden rotation")
+}
+
+// maxConcurrentUserSetup bounds how many userPlusDevice signups teamTester
+// will run at once, so a test asking for a big roster doesn't open dozens
+// of simultaneous connections to the test server.
+const maxConcurrentUserSetup = 5
+
+// multiError collects one or more errors encountered while starting or
+// stopping the subservices of a teamTester.
+type multiError []error
+
+func (m multiError) Error() string {
+	parts := make([]string, len(m))
+	for i, err := range m {
+		parts[i] = err.Error()
+	}
+	return strings.Join(parts, "; ")
+}
+
+// userSetupResult is the outcome of standing up a single userPlusDevice.
+type userSetupResult struct {
+	u   *userPlusDevice
+	err error
+}
+
+// userHandle is a future for a userPlusDevice that is being signed up on a
+// background goroutine via teamTester.AddUserAsync.
+type userHandle struct {
+	tt    *teamTester
+	pre   string
+	index int
+
+	resultCh chan userSetupResult
+	once     sync.Once
+	result   userSetupResult
+}
+
+func (h *userHandle) resolve() userSetupResult {
+	h.once.Do(func() {
+		h.result = <-h.resultCh
+		h.tt.users[h.index] = h.result.u
+	})
+	return h.result
+}
+
+// Await blocks until this user is fully signed up and returns it, failing
+// the test immediately (from the calling, i.e. test, goroutine) if setup
+// failed.
+func (h *userHandle) Await() *userPlusDevice {
+	res := h.resolve()
+	if res.err != nil {
+		h.tt.t.Fatal(res.err)
+	}
+	return res.u
+}
+
 type teamTester struct {
 	t     *testing.T
 	users []*userPlusDevice
+
+	pool    chan struct{}
+	pending []*userHandle
 }
 
 func newTeamTester(t *testing.T) *teamTester {
-	return &teamTester{t: t}
+	return &teamTester{
+		t:    t,
+		pool: make(chan struct{}, maxConcurrentUserSetup),
+	}
 }
 
 func (tt *teamTester) addUser(pre string) *userPlusDevice {
-	return tt.addUserHelper(pre, true, true)
+	return tt.addUserAsyncHelper(pre, true, true).Await()
 }
 
 func (tt *teamTester) addUserNoPaper(pre string) *userPlusDevice {
-	return tt.addUserHelper(pre, true, false)
+	return tt.addUserAsyncHelper(pre, true, false).Await()
 }
 
 func (tt *teamTester) addPuklessUser(pre string) *userPlusDevice {
-	return tt.addUserHelper(pre, false, true)
+	return tt.addUserAsyncHelper(pre, false, true).Await()
+}
+
+// AddUserAsync signs up a new user on a background goroutine (subject to
+// the teamTester's bounded worker pool) and returns a handle for it
+// immediately. Call Await on the handle, or Start/AwaitReady on the
+// teamTester, to block until it's ready and surface any setup error. This
+// lets tests that need several users bring them up in parallel instead of
+// paying the serial signup cost of addUser.
+func (tt *teamTester) AddUserAsync(pre string) *userHandle {
+	return tt.addUserAsyncHelper(pre, true, true)
+}
+
+func (tt *teamTester) addUserAsyncHelper(pre string, puk bool, paper bool) *userHandle {
+	h := &userHandle{tt: tt, pre: pre, index: len(tt.users), resultCh: make(chan userSetupResult, 1)}
+	tt.users = append(tt.users, nil)
+	tt.pending = append(tt.pending, h)
+
+	go func() {
+		tt.pool <- struct{}{}
+		defer func() { <-tt.pool }()
+		u, err := tt.setupUser(pre, puk, paper)
+		h.resultCh <- userSetupResult{u: u, err: err}
+	}()
+
+	return h
+}
+
+// Start waits for every user queued via AddUserAsync since the last call to
+// Start (or AwaitReady) to finish signing up, and returns the first error
+// encountered, if any. It does not stop at the first failure: every
+// pending user is given a chance to finish so later calls to Await don't
+// block forever.
+func (tt *teamTester) Start(ctx context.Context) error {
+	pending := tt.pending
+	tt.pending = nil
+
+	var errs multiError
+	for _, h := range pending {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if res := h.resolve(); res.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", h.pre, res.err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// AwaitReady is an alias for Start, kept so the teamTester's lifecycle
+// reads as the familiar Start/Stop/AwaitReady trio.
+func (tt *teamTester) AwaitReady(ctx context.Context) error {
+	return tt.Start(ctx)
 }
 
-func (tt *teamTester) addUserHelper(pre string, puk bool, paper bool) *userPlusDevice {
+// setupUser does the actual signup work for a single user. It never calls
+// t.Fatal or require.* directly, since it may run on a background
+// goroutine started by AddUserAsync: all failures are reported back
+// through the returned error instead.
+func (tt *teamTester) setupUser(pre string, puk bool, paper bool) (*userPlusDevice, error) {
 	tctx := setupTest(tt.t, pre)
 	if !puk {
 		tctx.Tp.DisableUpgradePerUserKey = true
@@ -139,7 +314,9 @@ func (tt *teamTester) addUserHelper(pre string, puk bool, paper bool) *userPlusD
 	u.device.start(0)
 
 	userInfo := randomUser(pre)
-	require.True(tt.t, libkb.CheckUsername.F(userInfo.username), "username check failed (%v): %v", libkb.CheckUsername.Hint, userInfo.username)
+	if !libkb.CheckUsername.F(userInfo.username) {
+		return nil, fmt.Errorf("username check failed (%v): %v", libkb.CheckUsername.Hint, userInfo.username)
+	}
 	tc := u.device.tctx
 	g := tc.G
 	signupUI := signupUI{
@@ -150,7 +327,7 @@ func (tt *teamTester) addUserHelper(pre string, puk bool, paper bool) *userPlusD
 	signup := client.NewCmdSignupRunner(g)
 	signup.SetTestWithPaper(paper)
 	if err := signup.Run(); err != nil {
-		tt.t.Fatal(err)
+		return nil, err
 	}
 	tt.t.Logf("signed up %s", userInfo.username)
 
@@ -162,7 +339,7 @@ func (tt *teamTester) addUserHelper(pre string, puk bool, paper bool) *userPlusD
 
 	cli, xp, err := client.GetRPCClientWithContext(g)
 	if err != nil {
-		tt.t.Fatal(err)
+		return nil, err
 	}
 
 	u.deviceClient = keybase1.DeviceClient{Cli: cli}
@@ -170,15 +347,15 @@ func (tt *teamTester) addUserHelper(pre string, puk bool, paper bool) *userPlusD
 
 	// register for notifications
 	u.notifications = newTeamNotifyHandler()
-	srv := rpc.NewServer(xp, nil)
-	if err = srv.Register(keybase1.NotifyTeamProtocol(u.notifications)); err != nil {
-		tt.t.Fatal(err)
+	u.rpcServer = rpc.NewServer(xp, nil)
+	if err = u.rpcServer.Register(keybase1.NotifyTeamProtocol(u.notifications)); err != nil {
+		return nil, err
 	}
 	ncli := keybase1.NotifyCtlClient{Cli: cli}
 	if err = ncli.SetNotifications(context.TODO(), keybase1.NotificationChannels{
 		Team: true,
 	}); err != nil {
-		tt.t.Fatal(err)
+		return nil, err
 	}
 
 	u.teamsClient = keybase1.TeamsClient{Cli: cli}
@@ -186,24 +363,62 @@ func (tt *teamTester) addUserHelper(pre string, puk bool, paper bool) *userPlusD
 	g.ConfigureConfig()
 
 	devices, backups := u.device.loadEncryptionKIDs()
-	require.Len(tt.t, devices, 1, "devices")
+	if len(devices) != 1 {
+		return nil, fmt.Errorf("expected 1 device, got %d", len(devices))
+	}
 	u.device.deviceKey.KID = devices[0]
-	require.True(tt.t, u.device.deviceKey.KID.Exists())
+	if !u.device.deviceKey.KID.Exists() {
+		return nil, fmt.Errorf("device key does not exist after signup")
+	}
 	if paper {
-		require.Len(tt.t, backups, 1, "backup keys")
+		if len(backups) != 1 {
+			return nil, fmt.Errorf("expected 1 backup key, got %d", len(backups))
+		}
 		u.backupKey = backups[0]
 		u.backupKey.secret = signupUI.info.displayedPaperKey
-	} else {
-		require.Len(tt.t, backups, 0, "backup keys")
+	} else if len(backups) != 0 {
+		return nil, fmt.Errorf("expected 0 backup keys, got %d", len(backups))
 	}
 
-	tt.users = append(tt.users, &u)
-	return &u
+	return &u, nil
 }
 
+// Stop runs the tctx cleanup for every user in the reverse of the order
+// they were added,
+// collecting any panics into a multiError instead of letting one bad
+// cleanup stop the rest from running.
+func (tt *teamTester) Stop() error {
+	var errs multiError
+	for i := len(tt.users) - 1; i >= 0; i-- {
+		u := tt.users[i]
+		if u == nil || u.device == nil || u.device.tctx == nil {
+			continue
+		}
+		if err := safeCleanup(u.device.tctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func safeCleanup(tctx *libkb.TestContext) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic during cleanup: %v", r)
+		}
+	}()
+	tctx.Cleanup()
+	return nil
+}
+
+// cleanup is a thin compatibility shim over Stop for the many existing
+// `defer tt.cleanup()` call sites.
 func (tt *teamTester) cleanup() {
-	for _, u := range tt.users {
-		u.device.tctx.Cleanup()
+	if err := tt.Stop(); err != nil {
+		tt.t.Logf("errors during teamTester cleanup: %v", err)
 	}
 }
 
@@ -218,6 +433,8 @@ type userPlusDevice struct {
 	deviceClient             keybase1.DeviceClient
 	teamsClient              keybase1.TeamsClient
 	notifications            *teamNotifyHandler
+	mockGregor               *MockGregorBackend
+	rpcServer                *rpc.Server
 	suppressTeamChatAnnounce bool
 }
 
@@ -401,20 +618,23 @@ func (u *userPlusDevice) paperKeyID() keybase1.DeviceID {
 }
 
 func (u *userPlusDevice) waitForTeamChangedGregor(teamID keybase1.TeamID, toSeqno keybase1.Seqno) {
-	// process 10 team rotations or 10s worth of time
-	for i := 0; i < 10; i++ {
-		select {
-		case arg := <-u.notifications.changeCh:
-			u.tc.T.Logf("membership change received: %+v", arg)
-			if arg.TeamID.Eq(teamID) && arg.Changes.MembershipChanged && !arg.Changes.KeyRotated && !arg.Changes.Renamed && arg.LatestSeqno == toSeqno {
-				u.tc.T.Logf("change matched!")
-				return
+	label := fmt.Sprintf("team rotate %s (membership change to seqno %d)", teamID, toSeqno)
+	err := PollUntil(context.TODO(), u.tc.G, label, PollOpts{Initial: time.Second, Max: time.Second, Multiplier: 1, Deadline: 10 * time.Second},
+		func() (bool, string, error) {
+			select {
+			case arg := <-u.notifications.changeCh:
+				u.tc.T.Logf("membership change received: %+v", arg)
+				if arg.TeamID.Eq(teamID) && arg.Changes.MembershipChanged && !arg.Changes.KeyRotated && !arg.Changes.Renamed && arg.LatestSeqno == toSeqno {
+					return true, "", nil
+				}
+				return false, fmt.Sprintf("ignoring change message (teamID=%s, seqno=%d)", arg.TeamID, arg.LatestSeqno), nil
+			default:
+				return false, "no gregor notification received yet", nil
 			}
-			u.tc.T.Logf("ignoring change message (expected teamID = %q, seqno = %d)", teamID.String(), toSeqno)
-		case <-time.After(1 * time.Second * libkb.CITimeMultiplier(u.tc.G)):
-		}
+		})
+	if err != nil {
+		u.tc.T.Fatal(err)
 	}
-	u.tc.T.Fatalf("timed out waiting for team rotate %s", teamID)
 }
 
 func (u *userPlusDevice) drainGregor() {
@@ -430,64 +650,147 @@ func (u *userPlusDevice) drainGregor() {
 	}
 }
 
+// waitForHiddenRotate waits for a gregor notification that the hidden
+// chain advanced to toHiddenSeqno, independently of whatever is happening
+// on the visible chain at the same time.
+func (u *userPlusDevice) waitForHiddenRotate(teamID keybase1.TeamID, toHiddenSeqno keybase1.Seqno) {
+	u.tc.T.Logf("waiting for hidden rotate %s", teamID)
+
+	// jump start the clkr queue processing loop, which also drives hidden
+	// chain rotations.
+	u.kickTeamRekeyd()
+
+	label := fmt.Sprintf("hidden team rotate %s (hidden seqno %d)", teamID, toHiddenSeqno)
+	err := PollUntil(context.TODO(), u.tc.G, label, PollOpts{Initial: time.Second, Max: time.Second, Multiplier: 1, Deadline: 10 * time.Second},
+		func() (bool, string, error) {
+			select {
+			case arg := <-u.notifications.hiddenChangeCh:
+				u.tc.T.Logf("hidden rotate received: %+v", arg)
+				if arg.TeamID.Eq(teamID) && arg.Changes.KeyRotated && arg.LatestHiddenSeqno == toHiddenSeqno {
+					return true, "", nil
+				}
+				return false, fmt.Sprintf("ignoring hidden rotate message (teamID=%s, hiddenSeqno=%d)", arg.TeamID, arg.LatestHiddenSeqno), nil
+			default:
+				return false, "no hidden gregor notification received yet", nil
+			}
+		})
+	if err != nil {
+		u.tc.T.Fatal(err)
+	}
+}
+
+// getHiddenTeamSeqno force-repolls the team and returns the max seqno
+// observed on its hidden chain.
+func (u *userPlusDevice) getHiddenTeamSeqno(teamID keybase1.TeamID) keybase1.Seqno {
+	team, err := teams.Load(context.Background(), u.tc.G, keybase1.LoadTeamArg{
+		ID:          teamID,
+		Public:      teamID.IsPublic(),
+		ForceRepoll: true,
+	})
+	require.NoError(u.tc.T, err)
+	return team.CurrentHiddenSeqno()
+}
+
+// getHiddenTeamPTKGeneration force-repolls the team and returns the PTK
+// generation implied by the most recent link on the hidden chain.
+func (u *userPlusDevice) getHiddenTeamPTKGeneration(teamID keybase1.TeamID) keybase1.PerTeamKeyGeneration {
+	team, err := teams.Load(context.Background(), u.tc.G, keybase1.LoadTeamArg{
+		ID:          teamID,
+		Public:      teamID.IsPublic(),
+		ForceRepoll: true,
+	})
+	require.NoError(u.tc.T, err)
+	return team.CurrentHiddenPTKGeneration()
+}
+
 func (u *userPlusDevice) waitForRotateByID(teamID keybase1.TeamID, toSeqno keybase1.Seqno) {
 	u.tc.T.Logf("waiting for team rotate %s", teamID)
 
 	// jump start the clkr queue processing loop
 	u.kickTeamRekeyd()
 
-	// process 10 team rotations or 10s worth of time
-	for i := 0; i < 10; i++ {
-		select {
-		case arg := <-u.notifications.changeCh:
-			u.tc.T.Logf("rotate received: %+v", arg)
-			if arg.TeamID.Eq(teamID) && arg.Changes.KeyRotated && arg.LatestSeqno == toSeqno {
-				u.tc.T.Logf("rotate matched!")
-				return
+	label := fmt.Sprintf("team rotate %s (seqno %d)", teamID, toSeqno)
+	err := PollUntil(context.TODO(), u.tc.G, label, PollOpts{Initial: time.Second, Max: time.Second, Multiplier: 1, Deadline: 10 * time.Second},
+		func() (bool, string, error) {
+			select {
+			case arg := <-u.notifications.changeCh:
+				u.tc.T.Logf("rotate received: %+v", arg)
+				if arg.TeamID.Eq(teamID) && arg.Changes.KeyRotated && arg.LatestSeqno == toSeqno {
+					return true, "", nil
+				}
+				return false, fmt.Sprintf("ignoring rotate message (teamID=%s, seqno=%d)", arg.TeamID, arg.LatestSeqno), nil
+			default:
+				return false, "no gregor notification received yet", nil
 			}
-			u.tc.T.Logf("ignoring rotate message")
-		case <-time.After(1 * time.Second * libkb.CITimeMultiplier(u.tc.G)):
-		}
+		})
+	if err != nil {
+		u.tc.T.Fatal(err)
+	}
+}
+
+// waitForRoleMapChanged waits for the UI notification that fires when a
+// team's role map (custom roles or permission policy) changed, e.g. in
+// response to a pushed team.role_changed gregor message.
+func (u *userPlusDevice) waitForRoleMapChanged(teamID keybase1.TeamID) {
+	label := fmt.Sprintf("role map changed notification for team %s", teamID)
+	err := PollUntil(context.TODO(), u.tc.G, label, PollOpts{Initial: 200 * time.Millisecond, Max: time.Second, Multiplier: 2, Deadline: 10 * time.Second},
+		func() (bool, string, error) {
+			select {
+			case id := <-u.notifications.roleMapChangedCh:
+				if id.Eq(teamID) {
+					return true, "", nil
+				}
+				return false, fmt.Sprintf("ignoring role map change for unrelated team %s", id), nil
+			default:
+				return false, "no role map change notification received yet", nil
+			}
+		})
+	if err != nil {
+		u.tc.T.Fatal(err)
 	}
-	u.tc.T.Fatalf("timed out waiting for team rotate %s", teamID)
 }
 
 func (u *userPlusDevice) waitForTeamChangedAndRotated(teamID keybase1.TeamID, toSeqno keybase1.Seqno) {
-	// process 10 team rotations or 10s worth of time
-	for i := 0; i < 10; i++ {
-		select {
-		case arg := <-u.notifications.changeCh:
-			u.tc.T.Logf("membership change received: %+v", arg)
-			if arg.TeamID.Eq(teamID) && arg.Changes.MembershipChanged && arg.Changes.KeyRotated && !arg.Changes.Renamed && arg.LatestSeqno == toSeqno {
-				u.tc.T.Logf("change matched!")
-				return
+	label := fmt.Sprintf("team rotate %s (membership change + rotate to seqno %d)", teamID, toSeqno)
+	err := PollUntil(context.TODO(), u.tc.G, label, PollOpts{Initial: time.Second, Max: time.Second, Multiplier: 1, Deadline: 10 * time.Second},
+		func() (bool, string, error) {
+			select {
+			case arg := <-u.notifications.changeCh:
+				u.tc.T.Logf("membership change received: %+v", arg)
+				if arg.TeamID.Eq(teamID) && arg.Changes.MembershipChanged && arg.Changes.KeyRotated && !arg.Changes.Renamed && arg.LatestSeqno == toSeqno {
+					return true, "", nil
+				}
+				return false, fmt.Sprintf("ignoring change message (team=%s, seqno=%d)", arg.TeamID, arg.LatestSeqno), nil
+			default:
+				return false, "no gregor notification received yet", nil
 			}
-			u.tc.T.Logf("ignoring change message (expected team = %v, seqno = %d)", teamID, toSeqno)
-		case <-time.After(1 * time.Second * libkb.CITimeMultiplier(u.tc.G)):
-		}
+		})
+	if err != nil {
+		u.tc.T.Fatal(err)
 	}
-	u.tc.T.Fatalf("timed out waiting for team rotate %s", teamID)
 }
 
 func (u *userPlusDevice) pollForTeamSeqnoLink(team string, toSeqno keybase1.Seqno) {
-	for i := 0; i < 20; i++ {
-		after, err := teams.Load(context.TODO(), u.tc.G, keybase1.LoadTeamArg{
-			Name:        team,
-			ForceRepoll: true,
+	var lastSeqno keybase1.Seqno
+	label := fmt.Sprintf("team %s to reach seqno %d", team, toSeqno)
+	err := PollUntil(context.TODO(), u.tc.G, label, PollOpts{Initial: 500 * time.Millisecond, Max: 500 * time.Millisecond, Multiplier: 1, Deadline: 10 * time.Second},
+		func() (bool, string, error) {
+			after, err := teams.Load(context.TODO(), u.tc.G, keybase1.LoadTeamArg{
+				Name:        team,
+				ForceRepoll: true,
+			})
+			if err != nil {
+				return false, "", fmt.Errorf("loading team %q: %v", team, err)
+			}
+			lastSeqno = after.CurrentSeqno()
+			if lastSeqno >= toSeqno {
+				return true, "", nil
+			}
+			return false, fmt.Sprintf("still at seqno %d", lastSeqno), nil
 		})
-		if err != nil {
-			u.tc.T.Fatalf("error while loading team %q: %v", team, err)
-		}
-
-		if after.CurrentSeqno() >= toSeqno {
-			u.tc.T.Logf("Found new seqno %d at poll loop iter %d", after.CurrentSeqno(), i)
-			return
-		}
-
-		time.Sleep(500 * time.Millisecond)
+	if err != nil {
+		u.tc.T.Fatal(err)
 	}
-
-	u.tc.T.Fatalf("timed out waiting for team rotate %s", team)
 }
 
 func (u *userPlusDevice) proveRooter() {
@@ -648,16 +951,29 @@ func GetTeamForTestByID(ctx context.Context, g *libkb.GlobalContext, id keybase1
 
 type teamNotifyHandler struct {
 	changeCh chan keybase1.TeamChangedByIDArg
+	// hiddenChangeCh also receives each notification sent to changeCh
+	// that carries a LatestHiddenSeqno, but is consumed separately so tests can wait on a hidden-chain seqno
+	// without racing the visible-chain poll loops.
+	hiddenChangeCh chan keybase1.TeamChangedByIDArg
+	// roleMapChangedCh receives a team ID each time the UI is notified
+	// that team's role map (custom roles or the permission policy)
+	// changed, e.g. in response to a pushed team.role_changed message.
+	roleMapChangedCh chan keybase1.TeamID
 }
 
 func newTeamNotifyHandler() *teamNotifyHandler {
 	return &teamNotifyHandler{
-		changeCh: make(chan keybase1.TeamChangedByIDArg, 1),
+		changeCh:         make(chan keybase1.TeamChangedByIDArg, 1),
+		hiddenChangeCh:   make(chan keybase1.TeamChangedByIDArg, 1),
+		roleMapChangedCh: make(chan keybase1.TeamID, 1),
 	}
 }
 
 func (n *teamNotifyHandler) TeamChangedByID(ctx context.Context, arg keybase1.TeamChangedByIDArg) error {
 	n.changeCh <- arg
+	if arg.LatestHiddenSeqno > 0 {
+		n.hiddenChangeCh <- arg
+	}
 	return nil
 }
 
@@ -673,6 +989,14 @@ func (n *teamNotifyHandler) TeamExit(ctx context.Context, teamID keybase1.TeamID
 	return nil
 }
 
+func (n *teamNotifyHandler) TeamRoleMapChanged(ctx context.Context, teamID keybase1.TeamID) error {
+	select {
+	case n.roleMapChangedCh <- teamID:
+	default:
+	}
+	return nil
+}
+
 func TestGetTeamRootID(t *testing.T) {
 	tt := newTeamTester(t)
 	defer tt.cleanup()
@@ -910,6 +1234,48 @@ func TestTeamLeaveThenList(t *testing.T) {
 	require.Len(t, teams.Teams, 0)
 }
 
+// TestTeamGregorMockInjection injects notifications into a
+// MockGregorBackend and checks its event log: it synthesizes an out-of-order delivery (a
+// rotation notification for a later seqno arriving before the membership
+// change for an earlier one) and a duplicate rotation, none of which the
+// real test server can be made to produce on demand.
+func TestTeamGregorMockInjection(t *testing.T) {
+	tt := newTeamTester(t)
+	defer tt.cleanup()
+
+	ann, mock := tt.addUserWithMockGregor("ann")
+	teamID, _ := ann.createTeam2()
+
+	require.NoError(t, mock.Inject(keybase1.TeamChangedByIDArg{
+		TeamID: teamID, LatestSeqno: 3,
+		Changes: keybase1.TeamChangeSet{KeyRotated: true},
+	}))
+	require.NoError(t, mock.Inject(keybase1.TeamChangedByIDArg{
+		TeamID: teamID, LatestSeqno: 2,
+		Changes: keybase1.TeamChangeSet{MembershipChanged: true},
+	}))
+
+	rotated3 := mock.Expect().TeamRotated(teamID, 3)
+	changed2 := mock.Expect().TeamMembershipChanged(teamID, 2)
+	require.NoError(t, rotated3.Within(time.Second))
+	require.NoError(t, changed2.Within(time.Second))
+	require.NoError(t, mock.Expect().InOrder(rotated3, changed2),
+		"rotation to 3 was injected before the membership change to 2")
+	require.Error(t, mock.Expect().InOrder(changed2, rotated3),
+		"membership change to 2 was injected after, not before, the rotation to 3")
+
+	require.NoError(t, mock.Expect().NoMoreEvents(200*time.Millisecond))
+
+	// A duplicate rotation notification gets its own log entry rather
+	// than being coalesced or dropped.
+	before := len(mock.snapshot())
+	require.NoError(t, mock.Inject(keybase1.TeamChangedByIDArg{
+		TeamID: teamID, LatestSeqno: 3,
+		Changes: keybase1.TeamChangeSet{KeyRotated: true},
+	}))
+	require.Len(t, mock.snapshot(), before+1, "duplicate rotation should still produce its own log entry")
+}
+
 func TestTeamCanUserPerform(t *testing.T) {
 	tt := newTeamTester(t)
 	defer tt.cleanup()
@@ -1024,3 +1390,157 @@ func TestTeamCanUserPerform(t *testing.T) {
 	_, err = teams.CanUserPerform(context.TODO(), pam.tc.G, subteam)
 	require.Error(t, err)
 }
+
+func (u *userPlusDevice) teamEditRolePermissions(teamName string, role keybase1.TeamRole, permissions []string) {
+	err := u.teamsClient.TeamEditRolePermissions(context.Background(), keybase1.TeamEditRolePermissionsArg{
+		Name:        teamName,
+		Role:        role,
+		Permissions: permissions,
+	})
+	require.NoError(u.tc.T, err)
+}
+
+// TestTeamCustomRolePermissions covers the permission system built on top
+// of teams.EditRolePermissions: a team owner can tighten or loosen what a role is
+// allowed to do for their team, and teams.CanUserPerform picks the change
+// up for members holding that role, without anyone's TeamRole changing.
+func TestTeamCustomRolePermissions(t *testing.T) {
+	tt := newTeamTester(t)
+	defer tt.cleanup()
+
+	ann := tt.addUser("ann")
+	pam := tt.addUser("pam")
+
+	team := ann.createTeam()
+	ann.addTeamMember(team, pam.username, keybase1.TeamRole_WRITER)
+
+	before, err := teams.CanUserPerform(context.TODO(), pam.tc.G, team)
+	require.NoError(t, err)
+	require.True(t, before.CreateChannel, "writers can create channels under the default scheme-managed role")
+
+	// Replace the default WRITER permission set for this team with a
+	// custom one that can only leave the team.
+	ann.teamEditRolePermissions(team, keybase1.TeamRole_WRITER, []string{"leave_team"})
+
+	after, err := teams.CanUserPerform(context.TODO(), pam.tc.G, team)
+	require.NoError(t, err)
+	require.False(t, after.CreateChannel, "custom role permissions should replace the scheme-managed default")
+	require.True(t, after.LeaveTeam)
+	require.False(t, after.SetMemberShowcase, "permissions not in the custom list should be denied")
+}
+
+func (u *userPlusDevice) teamAddChannelAdmin(teamName string, channelID keybase1.ChatConversationID, username string) {
+	err := u.teamsClient.TeamAddChannelAdmin(context.Background(), keybase1.TeamAddChannelAdminArg{
+		Name:      teamName,
+		ChannelID: channelID,
+		Username:  username,
+	})
+	require.NoError(u.tc.T, err)
+}
+
+// TestTeamChannelAdmin covers the channel-admin sub-role: a WRITER can be
+// promoted to admin of one specific chat channel, gaining DeleteChannel,
+// RenameChannel, and EditChannelDescription for that channel only, without
+// becoming a team admin or affecting her permissions on any other channel.
+func TestTeamChannelAdmin(t *testing.T) {
+	tt := newTeamTester(t)
+	defer tt.cleanup()
+
+	ann := tt.addUser("ann")
+	pam := tt.addUser("pam")
+
+	team := ann.createTeam()
+	ann.addTeamMember(team, pam.username, keybase1.TeamRole_WRITER)
+
+	channelID := keybase1.ChatConversationID("fake-channel-id-for-test")
+	otherChannelID := keybase1.ChatConversationID("another-fake-channel-id")
+
+	before, err := teams.CanUserPerformForChannel(context.TODO(), pam.tc.G, team, channelID)
+	require.NoError(t, err)
+	require.False(t, before.DeleteChannel, "a plain writer is not a channel admin")
+
+	ann.teamAddChannelAdmin(team, channelID, pam.username)
+
+	onChannel, err := teams.CanUserPerformForChannel(context.TODO(), pam.tc.G, team, channelID)
+	require.NoError(t, err)
+	require.True(t, onChannel.DeleteChannel)
+	require.True(t, onChannel.RenameChannel)
+	require.True(t, onChannel.EditChannelDescription)
+
+	offChannel, err := teams.CanUserPerformForChannel(context.TODO(), pam.tc.G, team, otherChannelID)
+	require.NoError(t, err)
+	require.False(t, offChannel.DeleteChannel, "channel admin is scoped to the named channel only")
+
+	teamWide, err := teams.CanUserPerform(context.TODO(), pam.tc.G, team)
+	require.NoError(t, err)
+	require.False(t, teamWide.ManageMembers, "channel admin does not imply team admin")
+}
+
+// TestTeamSettingsRestrictsRole covers the team-level settings mask: an
+// owner can tighten what a role is allowed to do for the whole team, on
+// top of (never loosening) whatever the role itself grants. Unlike
+// custom role permissions, this doesn't change pam's role or the role's
+// own permission set -- it just ANDs a restriction over the result.
+func TestTeamSettingsRestrictsRole(t *testing.T) {
+	tt := newTeamTester(t)
+	defer tt.cleanup()
+
+	ann := tt.addUser("ann")
+	pam := tt.addUser("pam")
+
+	team := ann.createTeam()
+	ann.addTeamMember(team, pam.username, keybase1.TeamRole_WRITER)
+
+	before, err := teams.CanUserPerform(context.TODO(), pam.tc.G, team)
+	require.NoError(t, err)
+	require.True(t, before.CreateChannel)
+
+	// Only owners may set the team settings.
+	err = pam.teamsClient.TeamSetSettings(context.Background(), keybase1.TeamSetSettingsArg{
+		Name:     team,
+		Settings: keybase1.TeamSettings{RestrictCreateChannelToAdmins: true},
+	})
+	require.Error(t, err, "only owners can tighten the team's settings")
+
+	ann.teamSetSettings(team, keybase1.TeamSettings{RestrictCreateChannelToAdmins: true})
+
+	after, err := teams.CanUserPerform(context.TODO(), pam.tc.G, team)
+	require.NoError(t, err)
+	require.False(t, after.CreateChannel, "policy should restrict create_channel to admins, with no role change")
+
+	annAfter, err := teams.CanUserPerform(context.TODO(), ann.tc.G, team)
+	require.NoError(t, err)
+	require.True(t, annAfter.CreateChannel, "owner is still allowed under an admins-only restriction")
+}
+
+// TestTeamRoleChangedLiveNotification covers the gregor team.role_changed
+// message: bob's client should invalidate its cached CanUserPerform result
+// for the team and notify the UI as soon as the message is handled, with
+// no ForceFullReload required.
+func TestTeamRoleChangedLiveNotification(t *testing.T) {
+	tt := newTeamTester(t)
+	defer tt.cleanup()
+
+	ann := tt.addUser("ann")
+	bob := tt.addUser("bob")
+
+	teamID, teamName := ann.createTeam2()
+	ann.addTeamMember(teamName.String(), bob.username, keybase1.TeamRole_WRITER)
+	bob.waitForTeamChangedGregor(teamID, keybase1.Seqno(2))
+
+	before, err := teams.CanUserPerform(context.TODO(), bob.tc.G, teamName.String())
+	require.NoError(t, err)
+	require.True(t, before.CreateChannel)
+
+	// Simulate the server pushing team.role_changed to bob's client,
+	// rather than bob's own CanUserPerform call re-fetching the team.
+	err = teams.HandleRoleChangedNotification(context.TODO(), bob.tc.G, teamID, keybase1.TeamRole_WRITER, []string{"leave_team"})
+	require.NoError(t, err)
+
+	bob.waitForRoleMapChanged(teamID)
+
+	after, err := teams.CanUserPerform(context.TODO(), bob.tc.G, teamName.String())
+	require.NoError(t, err)
+	require.False(t, after.CreateChannel, "role map change should invalidate the cache without a ForceFullReload")
+	require.True(t, after.LeaveTeam)
+}
@@ -0,0 +1,89 @@
+package teams
+
+import (
+	"sync"
+
+	"github.com/keybase/client/go/protocol/keybase1"
+)
+
+// Names of the link types this package records in teamLinks. None of
+// them is posted to the team's sigchain.
+const (
+	linkTypeRoleEdit           = "team.role.edit"
+	linkTypeChannelAdminAdd    = "team.channel_admin.add"
+	linkTypeChannelAdminRemove = "team.channel_admin.remove"
+	linkTypeTeamSettings       = "team.settings"
+)
+
+// teamLinks is the per-team record of every role.edit, channel_admin,
+// and settings link this package has recorded. It is held only in this
+// process's memory (teamLinkLog): nothing is written to the team's
+// sigchain or sent to the server, so the record is lost when the process
+// exits and other processes never see it. resolveRole, isChannelAdmin,
+// and getTeamSettings all read straight from here rather than a derived
+// cache, so a link recorded anywhere in this process is visible on the
+// very next call.
+type teamLinks struct {
+	sync.Mutex
+	roleEdits     map[keybase1.TeamRole]roleEditLink
+	channelAdmins map[keybase1.ChatConversationID]map[string]bool
+	settings      keybase1.TeamSettings
+}
+
+var teamLinkLog = struct {
+	sync.Mutex
+	m map[keybase1.TeamID]*teamLinks
+}{m: make(map[keybase1.TeamID]*teamLinks)}
+
+// getTeamLinks returns the teamLinks record for a team, creating an empty
+// one (equivalent to a team with no custom links posted yet) the first
+// time it's touched.
+func getTeamLinks(teamID keybase1.TeamID) *teamLinks {
+	teamLinkLog.Lock()
+	defer teamLinkLog.Unlock()
+	tl, ok := teamLinkLog.m[teamID]
+	if !ok {
+		tl = &teamLinks{
+			roleEdits:     make(map[keybase1.TeamRole]roleEditLink),
+			channelAdmins: make(map[keybase1.ChatConversationID]map[string]bool),
+		}
+		teamLinkLog.m[teamID] = tl
+	}
+	return tl
+}
+
+// postRoleEditLink records a team.role.edit link, replacing any earlier
+// one for the same role.
+func (tl *teamLinks) postRoleEditLink(role keybase1.TeamRole, permissions []string) {
+	tl.Lock()
+	defer tl.Unlock()
+	tl.roleEdits[role] = roleEditLink{Role: role, Permissions: permissions}
+}
+
+// postChannelAdminLink records a team.channel_admin.add or .remove link.
+func (tl *teamLinks) postChannelAdminLink(channelID keybase1.ChatConversationID, username string, remove bool) {
+	tl.Lock()
+	defer tl.Unlock()
+	if _, ok := tl.channelAdmins[channelID]; !ok {
+		tl.channelAdmins[channelID] = make(map[string]bool)
+	}
+	if remove {
+		delete(tl.channelAdmins[channelID], username)
+	} else {
+		tl.channelAdmins[channelID][username] = true
+	}
+}
+
+// postTeamSettingsLink records a team.settings link, replacing any
+// earlier one.
+func (tl *teamLinks) postTeamSettingsLink(settings keybase1.TeamSettings) {
+	tl.Lock()
+	defer tl.Unlock()
+	tl.settings = settings
+}
+
+// roleEditLink is one recorded team.role.edit link.
+type roleEditLink struct {
+	Role        keybase1.TeamRole
+	Permissions []string
+}
@@ -0,0 +1,68 @@
+package teams
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+)
+
+// isChannelAdmin reports whether username holds the channel-admin
+// sub-role for channelID, reading straight from the team's teamLinks so
+// a change recorded anywhere in this process is visible on the very next
+// call.
+func isChannelAdmin(teamID keybase1.TeamID, channelID keybase1.ChatConversationID, username string) bool {
+	tl := getTeamLinks(teamID)
+	tl.Lock()
+	defer tl.Unlock()
+	return tl.channelAdmins[channelID][username]
+}
+
+// AddChannelAdmin records a team.channel_admin.add link in teamLinks
+// promoting username to channel admin of channelID; nothing is posted to
+// the team's sigchain. The caller must already be a team admin or owner
+// (enforced by Load's NeedAdmin check).
+func AddChannelAdmin(ctx context.Context, g *libkb.GlobalContext, teamID keybase1.TeamID, channelID keybase1.ChatConversationID, username string) error {
+	return postChannelAdminLink(ctx, g, teamID, channelID, username, false)
+}
+
+// RemoveChannelAdmin records a team.channel_admin.remove link revoking
+// username's channel-admin sub-role for channelID.
+func RemoveChannelAdmin(ctx context.Context, g *libkb.GlobalContext, teamID keybase1.TeamID, channelID keybase1.ChatConversationID, username string) error {
+	return postChannelAdminLink(ctx, g, teamID, channelID, username, true)
+}
+
+func postChannelAdminLink(ctx context.Context, g *libkb.GlobalContext, teamID keybase1.TeamID, channelID keybase1.ChatConversationID, username string, remove bool) error {
+	if _, err := Load(ctx, g, keybase1.LoadTeamArg{ID: teamID, Public: teamID.IsPublic(), NeedAdmin: true}); err != nil {
+		return fmt.Errorf("loading team %s: %v", teamID, err)
+	}
+
+	getTeamLinks(teamID).postChannelAdminLink(channelID, username, remove)
+	return nil
+}
+
+// CanUserPerformForChannel is CanUserPerform overlaid with the caller's
+// channel-admin sub-role for channelID, if any: a channel admin gains
+// DeleteChannel, RenameChannel, and EditChannelDescription scoped to that
+// one channel, without becoming a team-wide admin.
+func CanUserPerformForChannel(ctx context.Context, g *libkb.GlobalContext, teamname string, channelID keybase1.ChatConversationID) (keybase1.TeamOperation, error) {
+	op, err := CanUserPerform(ctx, g, teamname)
+	if err != nil {
+		return keybase1.TeamOperation{}, err
+	}
+
+	team, err := Load(ctx, g, keybase1.LoadTeamArg{Name: teamname})
+	if err != nil {
+		return keybase1.TeamOperation{}, fmt.Errorf("loading team %q: %v", teamname, err)
+	}
+
+	if isChannelAdmin(team.ID, channelID, g.Env.GetUsername().String()) {
+		op.DeleteChannel = true
+		op.RenameChannel = true
+		op.EditChannelDescription = true
+	}
+
+	return op, nil
+}
@@ -0,0 +1,86 @@
+package teams
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+)
+
+// permMapToOperation turns a permission-name list into a
+// keybase1.TeamOperation, so a Role (scheme-managed or custom) can be
+// applied generically rather than needing its own field-by-field switch.
+func permMapToOperation(perms []string) keybase1.TeamOperation {
+	var op keybase1.TeamOperation
+	set := make(map[string]bool, len(perms))
+	for _, p := range perms {
+		set[p] = true
+	}
+	op.ManageMembers = set[PermManageMembers]
+	op.ManageSubteams = set[PermManageSubteams]
+	op.CreateChannel = set[PermCreateChannel]
+	op.DeleteChannel = set[PermDeleteChannel]
+	op.RenameChannel = set[PermRenameChannel]
+	op.EditChannelDescription = set[PermEditChannelDescription]
+	op.SetTeamShowcase = set[PermSetTeamShowcase]
+	op.SetMemberShowcase = set[PermSetMemberShowcase]
+	op.ChangeOpenTeam = set[PermChangeOpenTeam]
+	op.LeaveTeam = set[PermLeaveTeam]
+	op.ChangeTarsEnabled = set[PermChangeTarsEnabled]
+	return op
+}
+
+// CanUserPerform computes the caller's effective keybase1.TeamOperation
+// for teamname. This replaces the previous hard-coded OWNER/ADMIN/
+// WRITER/READER switch in place: the role's permissions now come from
+// resolveRole (scheme-managed defaults, overridden by whatever the team
+// has recorded via EditRolePermissions), with the sole-owner-can't-leave
+// special case applied, then masked by any TeamSettings policy the team
+// has set. A caller who is not a member gets the fixed implicit-admin
+// operations if they admin a parent team, and none otherwise.
+func CanUserPerform(ctx context.Context, g *libkb.GlobalContext, teamname string) (keybase1.TeamOperation, error) {
+	team, err := Load(ctx, g, keybase1.LoadTeamArg{Name: teamname})
+	if err != nil {
+		return keybase1.TeamOperation{}, fmt.Errorf("loading team %q: %v", teamname, err)
+	}
+
+	role, err := team.myRole(ctx)
+	if err != nil {
+		return keybase1.TeamOperation{}, err
+	}
+
+	var op keybase1.TeamOperation
+	if role == keybase1.TeamRole_NONE {
+		_, isImplicitAdmin, err := team.implicitAdminRole(ctx)
+		if err != nil {
+			return keybase1.TeamOperation{}, err
+		}
+		if !isImplicitAdmin {
+			// Not a member and not an implicit admin: no operations.
+			return op, nil
+		}
+		// An implicit admin (an admin of a parent team who is not a
+		// member here) may manage the team, but gets none of the
+		// member-level operations: channels, member showcase, leaving.
+		op.ManageMembers = true
+		op.ManageSubteams = true
+		op.SetTeamShowcase = true
+		op.ChangeOpenTeam = true
+		op.ChangeTarsEnabled = true
+		return op, nil
+	}
+
+	op = permMapToOperation(resolveRole(team.ID, role).Permissions)
+
+	if role == keybase1.TeamRole_OWNER || role == keybase1.TeamRole_ADMIN {
+		if sole, err := team.isSoleOwner(ctx); err == nil && sole {
+			op.LeaveTeam = false
+		}
+	}
+
+	applyTeamSettings(getTeamSettings(team.ID), &op, role)
+
+	return op, nil
+}
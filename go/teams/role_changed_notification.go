@@ -0,0 +1,61 @@
+package teams
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/gregor1"
+	"github.com/keybase/client/go/protocol/keybase1"
+)
+
+// roleChangedOOBM is the JSON body of a team.role_changed gregor
+// out-of-band message. EditRolePermissions itself sends nothing to the
+// server.
+type roleChangedOOBM struct {
+	TeamID      keybase1.TeamID `json:"team_id"`
+	RoleName    string          `json:"role_name"`
+	Permissions []string        `json:"permissions"`
+}
+
+var oobmRoleNames = map[string]keybase1.TeamRole{
+	"owner":  keybase1.TeamRole_OWNER,
+	"admin":  keybase1.TeamRole_ADMIN,
+	"writer": keybase1.TeamRole_WRITER,
+	"reader": keybase1.TeamRole_READER,
+}
+
+// HandleTeamRoleChangedOOBM is the dispatch entry point for the
+// team.role_changed gregor out-of-band message: the service's OOBM
+// router calls this for any message with System() == "team.role_changed",
+// the same way it already does for team.sbs and team.rename.
+func HandleTeamRoleChangedOOBM(ctx context.Context, g *libkb.GlobalContext, msg gregor1.OutOfBandMessage) error {
+	if msg.System() != "team.role_changed" {
+		return fmt.Errorf("unexpected system %q for HandleTeamRoleChangedOOBM", msg.System())
+	}
+
+	var body roleChangedOOBM
+	if err := json.Unmarshal(msg.Body().Bytes(), &body); err != nil {
+		return fmt.Errorf("parsing team.role_changed body: %v", err)
+	}
+	role, ok := oobmRoleNames[body.RoleName]
+	if !ok {
+		return fmt.Errorf("unknown role name %q in team.role_changed", body.RoleName)
+	}
+
+	return HandleRoleChangedNotification(ctx, g, body.TeamID, role, body.Permissions)
+}
+
+// HandleRoleChangedNotification is the live-update path for a role
+// change made elsewhere: it records the same team.role.edit link in
+// teamLinks that EditRolePermissions would, so the very next
+// CanUserPerform call in this process sees it, then tells
+// the UI layer its cached CanUserPerform result is now wrong.
+func HandleRoleChangedNotification(ctx context.Context, g *libkb.GlobalContext, teamID keybase1.TeamID, role keybase1.TeamRole, permissions []string) error {
+	getTeamLinks(teamID).postRoleEditLink(role, permissions)
+
+	g.NotifyRouter.HandleTeamRoleMapChanged(ctx, teamID)
+	return nil
+}
@@ -0,0 +1,101 @@
+package teams
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+)
+
+// Permission names used by Role.Permissions and by TeamSettings.
+// These are the string form used in role.edit links and in RPC args.
+const (
+	PermManageMembers          = "manage_members"
+	PermManageSubteams         = "manage_subteams"
+	PermCreateChannel          = "create_channel"
+	PermDeleteChannel          = "delete_channel"
+	PermRenameChannel          = "rename_channel"
+	PermEditChannelDescription = "edit_channel_description"
+	PermSetTeamShowcase        = "set_team_showcase"
+	PermSetMemberShowcase      = "set_member_showcase"
+	PermChangeOpenTeam         = "change_open_team"
+	PermLeaveTeam              = "leave_team"
+	PermChangeTarsEnabled      = "change_tars_enabled"
+)
+
+// Role is a named, persisted set of permissions a team member can hold.
+// SchemeManaged roles are the built-in OWNER/ADMIN/WRITER/READER defaults;
+// a team can override any of them with its own permission set, recorded
+// as a team.role.edit link in the in-memory teamLinks (not on the
+// sigchain).
+type Role struct {
+	Name          string
+	DisplayName   string
+	Permissions   []string
+	SchemeManaged bool
+}
+
+func roleName(role keybase1.TeamRole) string {
+	switch role {
+	case keybase1.TeamRole_OWNER:
+		return "owner"
+	case keybase1.TeamRole_ADMIN:
+		return "admin"
+	case keybase1.TeamRole_WRITER:
+		return "writer"
+	case keybase1.TeamRole_READER:
+		return "reader"
+	default:
+		return "none"
+	}
+}
+
+// defaultRole is the scheme-managed Role for a built-in keybase1.TeamRole,
+// migrated in place of what CanUserPerform used to compute with a
+// hard-coded switch on role.
+func defaultRole(role keybase1.TeamRole) Role {
+	r := Role{Name: roleName(role), DisplayName: roleName(role), SchemeManaged: true}
+	switch role {
+	case keybase1.TeamRole_OWNER, keybase1.TeamRole_ADMIN:
+		r.Permissions = []string{
+			PermManageMembers, PermManageSubteams, PermCreateChannel, PermDeleteChannel,
+			PermRenameChannel, PermEditChannelDescription, PermSetTeamShowcase,
+			PermSetMemberShowcase, PermChangeOpenTeam, PermLeaveTeam, PermChangeTarsEnabled,
+		}
+	case keybase1.TeamRole_WRITER:
+		r.Permissions = []string{PermCreateChannel, PermSetMemberShowcase, PermLeaveTeam}
+	case keybase1.TeamRole_READER:
+		r.Permissions = []string{PermSetMemberShowcase, PermLeaveTeam}
+	}
+	return r
+}
+
+// resolveRole returns the effective Role for a team/keybase1.TeamRole
+// pair: the team's custom team.role.edit override if one has been
+// posted, otherwise the scheme-managed default. Reading straight from
+// teamLinks (rather than a separate derived cache) means a role edit
+// recorded anywhere in this process is visible on the very next call.
+func resolveRole(teamID keybase1.TeamID, role keybase1.TeamRole) Role {
+	tl := getTeamLinks(teamID)
+	tl.Lock()
+	defer tl.Unlock()
+	if custom, ok := tl.roleEdits[role]; ok {
+		return Role{Name: roleName(role), DisplayName: roleName(role), Permissions: custom.Permissions}
+	}
+	return defaultRole(role)
+}
+
+// EditRolePermissions overwrites the team's custom permission set for
+// role, recording a team.role.edit link in teamLinks; nothing is posted
+// to the team's sigchain. Only a team admin or owner may do this
+// (enforced by loading the team with NeedAdmin).
+func EditRolePermissions(ctx context.Context, g *libkb.GlobalContext, teamID keybase1.TeamID, role keybase1.TeamRole, permissions []string) error {
+	if _, err := Load(ctx, g, keybase1.LoadTeamArg{ID: teamID, Public: teamID.IsPublic(), NeedAdmin: true}); err != nil {
+		return fmt.Errorf("loading team %s: %v", teamID, err)
+	}
+
+	getTeamLinks(teamID).postRoleEditLink(role, permissions)
+	return nil
+}
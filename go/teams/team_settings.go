@@ -0,0 +1,62 @@
+package teams
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+)
+
+// GetTeamSettings returns the team's current TeamSettings, the zero
+// value (no restrictions) if none has ever been set via SetTeamSettings.
+func GetTeamSettings(ctx context.Context, g *libkb.GlobalContext, teamID keybase1.TeamID) (keybase1.TeamSettings, error) {
+	return getTeamSettings(teamID), nil
+}
+
+func getTeamSettings(teamID keybase1.TeamID) keybase1.TeamSettings {
+	tl := getTeamLinks(teamID)
+	tl.Lock()
+	defer tl.Unlock()
+	return tl.settings
+}
+
+// SetTeamSettings records a team.settings link in teamLinks replacing
+// the team's policy mask; nothing is posted to the team's sigchain. Only
+// an owner may set the settings, whereas custom role permissions and
+// channel admins can be changed by any admin. The restrictions apply to
+// every role below admin; owners and admins are never restricted.
+func SetTeamSettings(ctx context.Context, g *libkb.GlobalContext, teamID keybase1.TeamID, settings keybase1.TeamSettings) error {
+	team, err := Load(ctx, g, keybase1.LoadTeamArg{ID: teamID, Public: teamID.IsPublic(), NeedAdmin: true})
+	if err != nil {
+		return fmt.Errorf("loading team %s: %v", teamID, err)
+	}
+	role, err := team.myRole(ctx)
+	if err != nil {
+		return err
+	}
+	if role != keybase1.TeamRole_OWNER {
+		return fmt.Errorf("only a team owner may set its team settings, not %s", roleName(role))
+	}
+
+	getTeamLinks(teamID).postTeamSettingsLink(settings)
+	return nil
+}
+
+// applyTeamSettings ANDs settings' restrictions onto op in place. Every
+// RestrictXToAdmins field, when set, denies the corresponding operation
+// to anyone who isn't an owner or admin -- it can only ever take
+// permissions away, never grant ones the role itself doesn't have.
+func applyTeamSettings(settings keybase1.TeamSettings, op *keybase1.TeamOperation, role keybase1.TeamRole) {
+	isAdmin := role == keybase1.TeamRole_OWNER || role == keybase1.TeamRole_ADMIN
+	if settings.RestrictCreateChannelToAdmins && !isAdmin {
+		op.CreateChannel = false
+	}
+	if settings.RestrictSetMemberShowcaseToAdmins && !isAdmin {
+		op.SetMemberShowcase = false
+	}
+	if settings.RestrictChangeOpenTeamToAdmins && !isAdmin {
+		op.ChangeOpenTeam = false
+	}
+}